@@ -0,0 +1,272 @@
+// Package consumer reads activity events from Kafka and stores them in
+// Postgres. The Kafka reader and the database sit behind the MessageSource
+// and Store interfaces so the batching logic can be tested without either.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type InfoData struct {
+	ActivityUUID       string    `json:"activity_uuid"`
+	UserUID            string    `json:"user_id"`
+	OrganizationID     string    `json:"organization_id"`
+	Timestamp          time.Time `json:"timestamp"`
+	AppName            string    `json:"app_name"`
+	URL                string    `json:"url"`
+	PageTitle          string    `json:"page_title"`
+	ProductivityStatus string    `json:"productivity_status"`
+	Meridian           string    `json:"meridian"`
+	IPAddress          string    `json:"ip_address"`
+	MacAddress         string    `json:"mac_address"`
+	MouseMovement      bool      `json:"mouse_movement"`
+	MouseClicks        int       `json:"mouse_clicks"`
+	KeysClicks         int       `json:"keys_clicks"`
+	Status             int       `json:"status"`
+	CPUUsage           string    `json:"cpu_usage"`
+	RAMUsage           string    `json:"ram_usage"`
+	ScreenshotUID      string    `json:"screenshot_uid"`
+	ThumbnailUID       string    `json:"thumbnail_uid"`
+	Device_user_name   string    `json:"device_user_name"`
+}
+
+// Store persists activity records.
+type Store interface {
+	Insert(ctx context.Context, records []InfoData) error
+	EnsureSchema(ctx context.Context) error
+}
+
+// MessageSource fetches messages and commits their offsets. *kafka.Reader
+// satisfies it when configured with a GroupID.
+type MessageSource interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Config controls batching.
+type Config struct {
+	// BatchSize is the number of messages buffered before a flush.
+	BatchSize int
+	// FlushInterval flushes a partial batch once no message has arrived
+	// for this long.
+	FlushInterval time.Duration
+	// ReadTimeout bounds each fetch while the batch is empty.
+	ReadTimeout time.Duration
+	// RetryBackoff is how long to wait after a failed flush before trying
+	// again.
+	RetryBackoff time.Duration
+	// ShutdownTimeout bounds the final flush once Run's context is
+	// cancelled.
+	ShutdownTimeout time.Duration
+}
+
+// Consumer buffers messages from a MessageSource, writes them to a Store
+// and commits offsets only once the write has succeeded.
+type Consumer struct {
+	source  MessageSource
+	store   Store
+	decoder Decoder
+	cfg     Config
+
+	// pending holds fetched messages whose offsets are not yet committed.
+	pending    []kafka.Message
+	lastAppend time.Time
+	// retrying is set while the pending batch has failed to flush; no new
+	// messages are fetched until it succeeds.
+	retrying bool
+}
+
+func New(source MessageSource, store Store, decoder Decoder, cfg Config) *Consumer {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 10 * time.Second
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 5 * time.Second
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+	return &Consumer{source: source, store: store, decoder: decoder, cfg: cfg}
+}
+
+// Pending returns the number of buffered messages awaiting a flush.
+func (c *Consumer) Pending() int {
+	return len(c.pending)
+}
+
+// Run consumes until ctx is cancelled, then makes a final attempt to flush
+// whatever is still buffered.
+func (c *Consumer) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		// Keep retrying a failed batch before fetching anything new, so the
+		// batch can't grow while the store is down.
+		if c.retrying {
+			c.backoff(ctx)
+			if ctx.Err() != nil {
+				break
+			}
+			c.retrying = c.Flush(ctx) != nil
+			continue
+		}
+
+		if c.idleFlushDue() {
+			slog.Info("No new messages, flushing pending batch", "pending", len(c.pending))
+			c.retrying = c.Flush(ctx) != nil
+			continue
+		}
+
+		// While a partial batch is waiting, only block until it is due to be flushed.
+		readTimeout := c.cfg.ReadTimeout
+		if len(c.pending) > 0 && c.cfg.FlushInterval > 0 {
+			if untilFlush := c.cfg.FlushInterval - time.Since(c.lastAppend); untilFlush < readTimeout {
+				readTimeout = untilFlush
+			}
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, readTimeout)
+		m, err := c.source.FetchMessage(fetchCtx)
+		cancel()
+
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				if len(c.pending) == 0 {
+					slog.Debug("No new messages, waiting")
+				}
+			} else if ctx.Err() == nil {
+				slog.Error("Error reading Kafka message", "error", err)
+			}
+			continue
+		}
+
+		slog.Debug("Received message", "topic", m.Topic, "partition", m.Partition, "offset", m.Offset, "payload", string(m.Value))
+		c.pending = append(c.pending, m)
+		c.lastAppend = time.Now()
+
+		if len(c.pending) >= c.cfg.BatchSize {
+			c.retrying = c.Flush(ctx) != nil
+		}
+	}
+
+	slog.Info("Shutting down consumer", "pending", len(c.pending))
+	if len(c.pending) > 0 {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.cfg.ShutdownTimeout)
+		defer cancel()
+		if err := c.Flush(shutdownCtx); err != nil {
+			slog.Error("Final flush failed, uncommitted messages will be redelivered", "pending", len(c.pending), "error", err)
+		}
+	}
+}
+
+// idleFlushDue reports whether a partial batch has waited FlushInterval
+// without a new message arriving.
+func (c *Consumer) idleFlushDue() bool {
+	return len(c.pending) > 0 && c.cfg.FlushInterval > 0 && time.Since(c.lastAppend) >= c.cfg.FlushInterval
+}
+
+// backoff waits RetryBackoff, or until ctx is cancelled, so a failing
+// database isn't retried in a tight loop.
+func (c *Consumer) backoff(ctx context.Context) {
+	t := time.NewTimer(c.cfg.RetryBackoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// Flush writes the pending batch and commits its offsets. If the write
+// fails the batch is kept and retried on the next flush; records that were
+// already inserted are skipped by the store as duplicates.
+func (c *Consumer) Flush(ctx context.Context) error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	if err := c.ProcessBatch(ctx, c.pending); err != nil {
+		slog.Error("Error writing batch, offsets not committed", "messages", len(c.pending), "error", err)
+		return err
+	}
+
+	if err := c.source.CommitMessages(ctx, c.pending...); err != nil {
+		last := c.pending[len(c.pending)-1]
+		slog.Error("Error committing offsets", "topic", last.Topic, "offset", last.Offset, "error", err)
+		return err
+	}
+
+	c.pending = nil
+	return nil
+}
+
+// ProcessBatch decodes every message and writes the valid records to the
+// store in one call. A message may carry a JSON array of records, in which
+// case each element is handled on its own. Records that can't be decoded or
+// fail validation are logged and skipped, as are repeats of an
+// activity_uuid within the batch. Store errors and ErrRegistryUnavailable
+// are returned so the caller can hold off committing offsets.
+func (c *Consumer) ProcessBatch(ctx context.Context, messages []kafka.Message) error {
+	var records []InfoData
+	seen := make(map[string]bool)
+	var skipped int
+
+	for _, m := range messages {
+		payloads, err := splitPayload(m.Value)
+		if err != nil {
+			slog.Error("Error splitting message", "topic", m.Topic, "offset", m.Offset, "error", err)
+			skipped++
+			continue
+		}
+		if len(payloads) > 1 {
+			slog.Debug("Expanded array message", "topic", m.Topic, "offset", m.Offset, "records", len(payloads))
+		}
+
+		for i, payload := range payloads {
+			infoData, err := c.decoder.Decode(payload)
+			if errors.Is(err, ErrRegistryUnavailable) {
+				return err
+			}
+			if err != nil {
+				slog.Error("Error decoding record", "topic", m.Topic, "offset", m.Offset, "index", i, "error", err)
+				skipped++
+				continue
+			}
+			if err := validateRecord(infoData); err != nil {
+				slog.Error("Invalid record", "topic", m.Topic, "offset", m.Offset, "index", i, "error", err)
+				skipped++
+				continue
+			}
+			if seen[infoData.ActivityUUID] {
+				slog.Info("Duplicate record in batch, skipping", "activity_uuid", infoData.ActivityUUID)
+				skipped++
+				continue
+			}
+			seen[infoData.ActivityUUID] = true
+			records = append(records, infoData)
+		}
+	}
+
+	if len(records) > 0 {
+		if err := c.store.Insert(ctx, records); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Batch processed", "messages", len(messages), "records", len(records), "skipped", skipped)
+	return nil
+}
+
+// validateRecord rejects records that can't be stored. activity_uuid is the
+// table's primary key.
+func validateRecord(data InfoData) error {
+	if data.ActivityUUID == "" {
+		return fmt.Errorf("missing activity_uuid")
+	}
+	return nil
+}
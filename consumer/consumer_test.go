@@ -0,0 +1,358 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+type fakeStore struct {
+	mu      sync.Mutex
+	batches [][]InfoData
+	err     error
+	calls   int
+	// block makes Insert wait for its context, like a hung database.
+	block bool
+}
+
+func (s *fakeStore) Insert(ctx context.Context, records []InfoData) error {
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, records)
+	return nil
+}
+
+func (s *fakeStore) EnsureSchema(ctx context.Context) error { return nil }
+
+func (s *fakeStore) inserted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, batch := range s.batches {
+		for _, r := range batch {
+			ids = append(ids, r.ActivityUUID)
+		}
+	}
+	return ids
+}
+
+// fakeSource hands out queued messages and blocks until the context is
+// done once the queue is empty, like kafka.Reader.
+type fakeSource struct {
+	mu        sync.Mutex
+	queue     []kafka.Message
+	committed []kafka.Message
+}
+
+func (s *fakeSource) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	s.mu.Lock()
+	if len(s.queue) > 0 {
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		return m, nil
+	}
+	s.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (s *fakeSource) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = append(s.committed, msgs...)
+	return nil
+}
+
+func (s *fakeSource) committedOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var offsets []int64
+	for _, m := range s.committed {
+		offsets = append(offsets, m.Offset)
+	}
+	return offsets
+}
+
+func messages(values ...string) []kafka.Message {
+	msgs := make([]kafka.Message, len(values))
+	for i, v := range values {
+		msgs[i] = kafka.Message{Topic: "activity", Offset: int64(i), Value: []byte(v)}
+	}
+	return msgs
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string
+		want     []string
+	}{
+		{
+			name:     "single objects",
+			messages: []string{`{"activity_uuid":"a1"}`, `{"activity_uuid":"a2"}`},
+			want:     []string{"a1", "a2"},
+		},
+		{
+			name:     "invalid json is skipped",
+			messages: []string{`not json`, `{"activity_uuid":"a1"}`},
+			want:     []string{"a1"},
+		},
+		{
+			name:     "missing activity_uuid is rejected",
+			messages: []string{`{"user_id":"u1"}`, `{"activity_uuid":"a1"}`},
+			want:     []string{"a1"},
+		},
+		{
+			name:     "duplicates within a batch are dropped",
+			messages: []string{`{"activity_uuid":"a1"}`, `{"activity_uuid":"a1"}`, `[{"activity_uuid":"a1"},{"activity_uuid":"a2"}]`},
+			want:     []string{"a1", "a2"},
+		},
+		{
+			name:     "array messages are expanded",
+			messages: []string{` [{"activity_uuid":"a1"},{"activity_uuid":"a2"}]`, `{"activity_uuid":"a3"}`},
+			want:     []string{"a1", "a2", "a3"},
+		},
+		{
+			name:     "malformed array element does not abort the others",
+			messages: []string{`[{"activity_uuid":"a1"},{"activity_uuid":42},{"activity_uuid":"a3"}]`},
+			want:     []string{"a1", "a3"},
+		},
+		{
+			name:     "nothing valid",
+			messages: []string{`[]`, `{}`},
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{}
+			c := New(&fakeSource{}, store, JSONDecoder{}, Config{})
+
+			if err := c.ProcessBatch(context.Background(), messages(tt.messages...)); err != nil {
+				t.Fatalf("ProcessBatch: %v", err)
+			}
+			if got := store.inserted(); !equal(got, tt.want) {
+				t.Errorf("inserted %v, want %v", got, tt.want)
+			}
+			if len(tt.want) == 0 && len(store.batches) != 0 {
+				t.Errorf("Insert called with no records")
+			}
+		})
+	}
+}
+
+func TestFlushCommitsAfterWrite(t *testing.T) {
+	source := &fakeSource{}
+	store := &fakeStore{}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 10})
+	c.pending = messages(`{"activity_uuid":"a1"}`, `{"activity_uuid":"a2"}`)
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := source.committedOffsets(); len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("committed offsets %v, want [0 1]", got)
+	}
+	if c.Pending() != 0 {
+		t.Errorf("Pending() = %d after flush, want 0", c.Pending())
+	}
+}
+
+func TestFlushKeepsBatchOnStoreError(t *testing.T) {
+	source := &fakeSource{}
+	store := &fakeStore{err: errors.New("connection refused")}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 10})
+	c.pending = messages(`{"activity_uuid":"a1"}`)
+
+	if err := c.Flush(context.Background()); err == nil {
+		t.Fatal("Flush succeeded, want store error")
+	}
+	if got := source.committedOffsets(); len(got) != 0 {
+		t.Errorf("committed offsets %v after failed write, want none", got)
+	}
+	if c.Pending() != 1 {
+		t.Errorf("Pending() = %d, want batch kept for retry", c.Pending())
+	}
+
+	store.err = nil
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("retry Flush: %v", err)
+	}
+	if got := source.committedOffsets(); len(got) != 1 {
+		t.Errorf("committed offsets %v after retry, want [0]", got)
+	}
+}
+
+func TestRunFlushesFullBatch(t *testing.T) {
+	source := &fakeSource{queue: messages(`{"activity_uuid":"a1"}`, `{"activity_uuid":"a2"}`, `{"activity_uuid":"a3"}`)}
+	store := &fakeStore{}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 2, FlushInterval: time.Hour, ReadTimeout: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Run(ctx)
+
+	// The first two fill a batch; the third is flushed on shutdown.
+	if got := store.inserted(); !equal(got, []string{"a1", "a2", "a3"}) {
+		t.Errorf("inserted %v, want [a1 a2 a3]", got)
+	}
+	if len(store.batches) != 2 {
+		t.Errorf("got %d batches, want 2", len(store.batches))
+	}
+	if got := source.committedOffsets(); len(got) != 3 {
+		t.Errorf("committed offsets %v, want 3", got)
+	}
+}
+
+func TestRunFlushesIdleBatch(t *testing.T) {
+	source := &fakeSource{queue: messages(`{"activity_uuid":"a1"}`)}
+	store := &fakeStore{}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 100, FlushInterval: 20 * time.Millisecond, ReadTimeout: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(source.committedOffsets()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Check before cancelling so the shutdown flush can't mask a missing idle flush.
+	committed := source.committedOffsets()
+	cancel()
+	<-done
+
+	if len(committed) != 1 {
+		t.Fatalf("committed offsets %v, want idle flush to commit [0]", committed)
+	}
+	if len(store.batches) != 1 {
+		t.Errorf("got %d batches, want 1", len(store.batches))
+	}
+}
+
+func TestRunBacksOffAfterFailedFlush(t *testing.T) {
+	source := &fakeSource{queue: messages(`{"activity_uuid":"a1"}`)}
+	store := &fakeStore{err: errors.New("connection refused")}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 100, FlushInterval: time.Millisecond, ReadTimeout: time.Second, RetryBackoff: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+	defer cancel()
+	c.Run(ctx)
+
+	// Roughly one attempt per backoff plus the shutdown flush; a busy loop
+	// would make thousands.
+	if store.calls > 5 {
+		t.Errorf("Insert called %d times in 120ms with a 50ms backoff", store.calls)
+	}
+	if got := source.committedOffsets(); len(got) != 0 {
+		t.Errorf("committed offsets %v while the store was failing", got)
+	}
+}
+
+// failingDecoder reports the schema registry as unreachable.
+type failingDecoder struct{}
+
+func (failingDecoder) Decode(payload []byte) (InfoData, error) {
+	return InfoData{}, fmt.Errorf("error fetching schema 7: %w", ErrRegistryUnavailable)
+}
+
+func TestFlushKeepsBatchWhenRegistryUnavailable(t *testing.T) {
+	source := &fakeSource{}
+	store := &fakeStore{}
+	c := New(source, store, failingDecoder{}, Config{BatchSize: 10})
+	c.pending = messages(`avro-1`, `avro-2`)
+
+	if err := c.Flush(context.Background()); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Flush error = %v, want ErrRegistryUnavailable", err)
+	}
+	if got := source.committedOffsets(); len(got) != 0 {
+		t.Errorf("committed offsets %v while the registry was down, want none", got)
+	}
+	if c.Pending() != 2 {
+		t.Errorf("Pending() = %d, want batch kept for retry", c.Pending())
+	}
+}
+
+func TestRunStopsFetchingWhileFlushFails(t *testing.T) {
+	source := &fakeSource{queue: messages(`{"activity_uuid":"a1"}`, `{"activity_uuid":"a2"}`, `{"activity_uuid":"a3"}`)}
+	store := &fakeStore{err: errors.New("connection refused")}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 1, ReadTimeout: time.Second, RetryBackoff: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Run(ctx)
+
+	if c.Pending() != 1 {
+		t.Errorf("Pending() = %d, want only the failed message buffered", c.Pending())
+	}
+	source.mu.Lock()
+	remaining := len(source.queue)
+	source.mu.Unlock()
+	if remaining != 2 {
+		t.Errorf("%d messages left unfetched, want 2", remaining)
+	}
+	if store.calls < 3 {
+		t.Errorf("Insert called %d times, want the failed batch retried", store.calls)
+	}
+}
+
+func TestRunShutdownFlushTimesOut(t *testing.T) {
+	source := &fakeSource{queue: messages(`{"activity_uuid":"a1"}`)}
+	store := &fakeStore{block: true}
+	c := New(source, store, JSONDecoder{}, Config{BatchSize: 100, FlushInterval: time.Hour, ReadTimeout: 10 * time.Millisecond, ShutdownTimeout: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return; shutdown flush ignored ShutdownTimeout")
+	}
+	if got := source.committedOffsets(); len(got) != 0 {
+		t.Errorf("committed offsets %v after a failed shutdown flush", got)
+	}
+}
@@ -0,0 +1,225 @@
+package consumer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// ErrRegistryUnavailable wraps schema registry failures that may clear up on
+// retry, such as a network error, a 5xx response or rejected credentials.
+// Messages that fail with it must not be skipped, or they'd be lost once
+// their offsets commit.
+var ErrRegistryUnavailable = errors.New("schema registry unavailable")
+
+// schemaNotFoundCode is the Confluent error_code for an unknown schema ID. A
+// 404 without it means the registry URL itself is wrong.
+const schemaNotFoundCode = 40403
+
+// Decoder turns a raw Kafka message value into an InfoData record.
+type Decoder interface {
+	Decode(payload []byte) (InfoData, error)
+}
+
+// NewDecoder returns the decoder for a payload format. JSON is the default
+// so existing topics keep working; "avro" expects Confluent Schema Registry
+// framing and requires registryURL, which is checked up front so a
+// misconfigured registry stops the consumer before it reads anything.
+func NewDecoder(format, registryURL string) (Decoder, error) {
+	switch strings.ToLower(format) {
+	case "", "json":
+		return JSONDecoder{}, nil
+	case "avro":
+		if registryURL == "" {
+			return nil, fmt.Errorf("a schema registry URL is required for avro payloads")
+		}
+		d := NewAvroDecoder(registryURL)
+		if err := d.Check(); err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported payload format %q", format)
+	}
+}
+
+// splitPayload returns the individual records in a message. Some agents
+// publish a JSON array of activities in a single message; those are split
+// into one payload per element. Anything else, including Avro, is returned
+// as a single payload.
+func splitPayload(payload []byte) ([][]byte, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return [][]byte{payload}, nil
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elements); err != nil {
+		return nil, fmt.Errorf("error unmarshalling array message: %v", err)
+	}
+
+	payloads := make([][]byte, len(elements))
+	for i, element := range elements {
+		payloads[i] = element
+	}
+	return payloads, nil
+}
+
+// JSONDecoder decodes plain JSON activity payloads.
+type JSONDecoder struct{}
+
+func (JSONDecoder) Decode(payload []byte) (InfoData, error) {
+	var infoData InfoData
+	err := json.Unmarshal(payload, &infoData)
+	return infoData, err
+}
+
+// AvroDecoder decodes Avro payloads in the Confluent wire format: a zero
+// magic byte, a 4-byte big-endian schema ID, then the Avro binary body.
+// Schemas are fetched from the registry on first use and cached by ID.
+type AvroDecoder struct {
+	registryURL string
+	client      *http.Client
+
+	mu     sync.Mutex
+	codecs map[uint32]*goavro.Codec
+}
+
+func NewAvroDecoder(registryURL string) *AvroDecoder {
+	return &AvroDecoder{
+		registryURL: strings.TrimRight(registryURL, "/"),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		codecs:      make(map[uint32]*goavro.Codec),
+	}
+}
+
+// Check confirms the registry is reachable and accepts our requests by
+// listing its subjects.
+func (d *AvroDecoder) Check() error {
+	resp, err := d.client.Get(d.registryURL + "/subjects")
+	if err != nil {
+		return fmt.Errorf("error reaching schema registry: %w: %v", ErrRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error reaching schema registry: %w: registry returned %s", ErrRegistryUnavailable, resp.Status)
+	}
+	return nil
+}
+
+func (d *AvroDecoder) Decode(payload []byte) (InfoData, error) {
+	var infoData InfoData
+	if len(payload) < 5 || payload[0] != 0 {
+		return infoData, fmt.Errorf("payload is not in schema registry wire format")
+	}
+	schemaID := binary.BigEndian.Uint32(payload[1:5])
+
+	codec, err := d.codec(schemaID)
+	if err != nil {
+		return infoData, err
+	}
+
+	native, _, err := codec.NativeFromBinary(payload[5:])
+	if err != nil {
+		return infoData, fmt.Errorf("error decoding avro payload with schema %d: %v", schemaID, err)
+	}
+	record, ok := native.(map[string]interface{})
+	if !ok {
+		return infoData, fmt.Errorf("schema %d does not describe a record", schemaID)
+	}
+
+	// Nullable fields decode as {"type": value}; unwrap them so the record
+	// maps onto InfoData's JSON tags.
+	for field, value := range record {
+		if union, ok := value.(map[string]interface{}); ok && len(union) == 1 {
+			for _, inner := range union {
+				record[field] = inner
+			}
+		}
+	}
+
+	// The timestamp-millis and timestamp-micros logical types already decode
+	// to time.Time; producers sending a plain long epoch need converting.
+	if epoch, ok := record["timestamp"].(int64); ok {
+		record["timestamp"] = epochToTime(epoch)
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return infoData, err
+	}
+	err = json.Unmarshal(encoded, &infoData)
+	return infoData, err
+}
+
+// epochToTime converts a Unix epoch in milliseconds or microseconds. Any
+// value from 1e14 up is taken as microseconds, since as milliseconds it
+// would be thousands of years out.
+func epochToTime(epoch int64) time.Time {
+	if epoch >= 1e14 || epoch <= -1e14 {
+		return time.UnixMicro(epoch).UTC()
+	}
+	return time.UnixMilli(epoch).UTC()
+}
+
+func (d *AvroDecoder) codec(schemaID uint32) (*goavro.Codec, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if codec, ok := d.codecs[schemaID]; ok {
+		return codec, nil
+	}
+
+	resp, err := d.client.Get(fmt.Sprintf("%s/schemas/ids/%d", d.registryURL, schemaID))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching schema %d: %w: %v", schemaID, ErrRegistryUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if registryErrorIsPermanent(resp) {
+			return nil, fmt.Errorf("error fetching schema %d: registry returned %s", schemaID, resp.Status)
+		}
+		return nil, fmt.Errorf("error fetching schema %d: %w: registry returned %s", schemaID, ErrRegistryUnavailable, resp.Status)
+	}
+
+	var body struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("error reading schema %d: %w: %v", schemaID, ErrRegistryUnavailable, err)
+	}
+
+	codec, err := goavro.NewCodec(body.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %d: %v", schemaID, err)
+	}
+	d.codecs[schemaID] = codec
+	return codec, nil
+}
+
+// registryErrorIsPermanent reports whether a failed schema lookup is down to
+// the message rather than the registry. Only a 404 carrying Confluent's
+// schema-not-found code, or another 4xx that isn't about credentials or rate
+// limiting, qualifies; anything else would fail for every message alike.
+func registryErrorIsPermanent(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	case http.StatusNotFound:
+		var body struct {
+			ErrorCode int `json:"error_code"`
+		}
+		return json.NewDecoder(resp.Body).Decode(&body) == nil && body.ErrorCode == schemaNotFoundCode
+	}
+	return resp.StatusCode >= 400 && resp.StatusCode < 500
+}
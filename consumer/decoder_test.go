@@ -0,0 +1,238 @@
+package consumer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+func TestSplitPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    []string
+		wantErr bool
+	}{
+		{payload: `{"activity_uuid":"a1"}`, want: []string{`{"activity_uuid":"a1"}`}},
+		{payload: "\n [{\"activity_uuid\":\"a1\"}, {\"activity_uuid\":\"a2\"}]", want: []string{`{"activity_uuid":"a1"}`, `{"activity_uuid":"a2"}`}},
+		{payload: `[]`, want: []string{}},
+		{payload: `[{"activity_uuid":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := splitPayload([]byte(tt.payload))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitPayload(%q) succeeded, want error", tt.payload)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitPayload(%q): %v", tt.payload, err)
+			continue
+		}
+		var gotStrings []string
+		for _, p := range got {
+			gotStrings = append(gotStrings, string(p))
+		}
+		if len(gotStrings) != len(tt.want) || !equal(gotStrings, tt.want) {
+			t.Errorf("splitPayload(%q) = %q, want %q", tt.payload, gotStrings, tt.want)
+		}
+	}
+}
+
+func TestNewDecoder(t *testing.T) {
+	status := http.StatusOK
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `[]`)
+	}))
+	defer registry.Close()
+
+	if d, err := NewDecoder("", ""); err != nil || d != (JSONDecoder{}) {
+		t.Errorf("NewDecoder(\"\") = %T, %v; want JSONDecoder", d, err)
+	}
+	if _, err := NewDecoder("avro", ""); err == nil {
+		t.Error("NewDecoder(avro) without registry URL succeeded, want error")
+	}
+	if d, err := NewDecoder("AVRO", registry.URL); err != nil {
+		t.Errorf("NewDecoder(AVRO): %v", err)
+	} else if _, ok := d.(*AvroDecoder); !ok {
+		t.Errorf("NewDecoder(AVRO) = %T, want *AvroDecoder", d)
+	}
+	status = http.StatusUnauthorized
+	if _, err := NewDecoder("avro", registry.URL); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Errorf("NewDecoder(avro) with rejected credentials error = %v, want ErrRegistryUnavailable", err)
+	}
+	if _, err := NewDecoder("avro", registry.URL+"/wrong"); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Errorf("NewDecoder(avro) with wrong path error = %v, want ErrRegistryUnavailable", err)
+	}
+	if _, err := NewDecoder("protobuf", ""); err == nil {
+		t.Error("NewDecoder(protobuf) succeeded, want error")
+	}
+}
+
+const testSchema = `{
+	"type": "record",
+	"name": "Activity",
+	"fields": [
+		{"name": "activity_uuid", "type": "string"},
+		{"name": "user_id", "type": ["null", "string"], "default": null},
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "mouse_clicks", "type": "int"}
+	]
+}`
+
+func TestAvroDecoder(t *testing.T) {
+	requests := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/schemas/ids/7" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error_code": 40403, "message": "Schema not found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"schema": %q}`, testSchema)
+	}))
+	defer registry.Close()
+
+	codec, err := goavro.NewCodec(testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	body, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"activity_uuid": "a1",
+		"user_id":       goavro.Union("string", "u1"),
+		"timestamp":     ts,
+		"mouse_clicks":  3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte{0, 0, 0, 0, 0}, body...)
+	binary.BigEndian.PutUint32(payload[1:5], 7)
+
+	d := NewAvroDecoder(registry.URL + "/")
+	for i := 0; i < 2; i++ {
+		got, err := d.Decode(payload)
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if got.ActivityUUID != "a1" || got.UserUID != "u1" || !got.Timestamp.Equal(ts) || got.MouseClicks != 3 {
+			t.Errorf("Decode = %+v", got)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("registry fetched %d times, want schema cached after first", requests)
+	}
+
+	if _, err := d.Decode([]byte(`{"activity_uuid":"a1"}`)); err == nil || !strings.Contains(err.Error(), "wire format") {
+		t.Errorf("Decode(json) error = %v, want wire format error", err)
+	}
+
+	unknown := append([]byte{0, 0, 0, 0, 9}, body...)
+	if _, err := d.Decode(unknown); err == nil || errors.Is(err, ErrRegistryUnavailable) {
+		t.Errorf("Decode with unknown schema ID error = %v, want a non-retryable error", err)
+	}
+}
+
+func TestAvroDecoderRegistryUnavailable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	body := ""
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return
+		}
+		fmt.Fprintf(w, `{"schema": %q}`, testSchema)
+	}))
+	defer registry.Close()
+
+	payload := []byte{0, 0, 0, 0, 7}
+	d := NewAvroDecoder(registry.URL)
+
+	if _, err := d.Decode(payload); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode on 503 error = %v, want ErrRegistryUnavailable", err)
+	}
+
+	status = http.StatusUnauthorized
+	if _, err := d.Decode(payload); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode on 401 error = %v, want ErrRegistryUnavailable", err)
+	}
+
+	// A 404 without Confluent's schema-not-found code means the URL is wrong.
+	status = http.StatusNotFound
+	body = `<html>Not Found</html>`
+	if _, err := d.Decode(payload); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode on bare 404 error = %v, want ErrRegistryUnavailable", err)
+	}
+
+	body = `{"error_code": 40403, "message": "Schema not found"}`
+	if _, err := d.Decode(payload); err == nil || errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode on 40403 error = %v, want a non-retryable error", err)
+	}
+
+	registry.Close()
+	if _, err := d.Decode(payload); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Fatalf("Decode with registry down error = %v, want ErrRegistryUnavailable", err)
+	}
+}
+
+func TestAvroDecoderTimestampEncodings(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	schema := func(timestampType string) string {
+		return `{"type": "record", "name": "Activity", "fields": [
+			{"name": "activity_uuid", "type": "string"},
+			{"name": "timestamp", "type": ` + timestampType + `}
+		]}`
+	}
+	tests := []struct {
+		name   string
+		schema string
+		value  interface{}
+	}{
+		{"plain long millis", schema(`"long"`), ts.UnixMilli()},
+		{"plain long micros", schema(`"long"`), ts.UnixMicro()},
+		{"nullable long millis", schema(`["null", "long"]`), goavro.Union("long", ts.UnixMilli())},
+		{"timestamp-micros", schema(`{"type": "long", "logicalType": "timestamp-micros"}`), ts},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"schema": %q}`, tt.schema)
+			}))
+			defer registry.Close()
+
+			codec, err := goavro.NewCodec(tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := codec.BinaryFromNative(nil, map[string]interface{}{"activity_uuid": "a1", "timestamp": tt.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := append([]byte{0, 0, 0, 0, byte(i)}, body...)
+
+			got, err := NewAvroDecoder(registry.URL).Decode(payload)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !got.Timestamp.Equal(ts) {
+				t.Errorf("Timestamp = %v, want %v", got.Timestamp, ts)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+
+	"github.com/lib/pq"
+)
+
+// DefaultTableName is used when no table name is configured.
+const DefaultTableName = "user_activity"
+
+// Table names can't be bound as query parameters, so only plain lowercase
+// Postgres identifiers are accepted, and they are always quoted with
+// pq.QuoteIdentifier so reserved words like "user" still work.
+var tableNamePattern = regexp.MustCompile(fmt.Sprintf(`^[a-z_][a-z0-9_]{0,%d}$`, maxTableNameLen-1))
+
+// Index names are the table name plus one of these suffixes.
+const (
+	orgUserTimestampIndexSuffix = "_org_user_ts_idx"
+	timestampIndexSuffix        = "_ts_idx"
+)
+
+// maxTableNameLen keeps every derived index name within Postgres' 63-byte
+// identifier limit; longer names would be truncated and could collide.
+const maxTableNameLen = 63 - len(orgUserTimestampIndexSuffix)
+
+// ValidateTableName reports whether name is safe to interpolate into SQL.
+func ValidateTableName(name string) error {
+	if !tableNamePattern.MatchString(name) {
+		return fmt.Errorf("table name %q must match %s", name, tableNamePattern.String())
+	}
+	return nil
+}
+
+// PostgresStore writes activity records to a Postgres table.
+type PostgresStore struct {
+	// RecreateOnMismatch lets EnsureSchema drop and recreate an existing
+	// table whose columns don't match. When false a mismatch is an error,
+	// so a mistyped table name can't destroy an unrelated table.
+	RecreateOnMismatch bool
+
+	db        *sql.DB
+	tableName string
+	stmts     *activityStatements
+}
+
+// NewPostgresStore returns a store for tableName. EnsureSchema must be
+// called before Insert.
+func NewPostgresStore(db *sql.DB, tableName string) (*PostgresStore, error) {
+	if err := ValidateTableName(tableName); err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db, tableName: tableName}, nil
+}
+
+// EnsureSchema creates or reconciles the table and its indexes, then
+// prepares the statements used by Insert.
+func (s *PostgresStore) EnsureSchema(ctx context.Context) error {
+	if err := ensureTableExists(ctx, s.db, s.tableName, s.RecreateOnMismatch); err != nil {
+		return err
+	}
+	inspectTableStructure(ctx, s.db, s.tableName)
+
+	if s.stmts != nil {
+		s.stmts.Close()
+	}
+	stmts, err := prepareStatements(ctx, s.db, s.tableName)
+	if err != nil {
+		return err
+	}
+	s.stmts = stmts
+	return nil
+}
+
+// Insert writes each record, skipping ones whose activity_uuid is already
+// stored. Records the database rejects as invalid data (a value too long for
+// its column, a constraint violation) are logged and dropped, since retrying
+// them can never succeed. Every record is attempted; the first other error,
+// such as a lost connection, is returned so the batch is retried.
+func (s *PostgresStore) Insert(ctx context.Context, records []InfoData) error {
+	if s.stmts == nil {
+		return fmt.Errorf("statements not prepared, call EnsureSchema first")
+	}
+
+	var firstErr error
+	for _, data := range records {
+		if err := insertOrUpdateProject(ctx, s.stmts, data); err != nil {
+			if isDataError(err) {
+				slog.Error("Record rejected by the database, skipping", "activity_uuid", data.ActivityUUID, "error", err)
+				continue
+			}
+			slog.Error("Error inserting/updating data", "activity_uuid", data.ActivityUUID, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	confirmDataAdded(ctx, s.stmts)
+	return firstErr
+}
+
+// isDataError reports whether err is a Postgres data exception (class 22)
+// or integrity constraint violation (class 23).
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
+
+// Close releases the prepared statements. The database handle is owned by
+// the caller.
+func (s *PostgresStore) Close() error {
+	if s.stmts != nil {
+		s.stmts.Close()
+		s.stmts = nil
+	}
+	return nil
+}
+
+func ensureTableExists(ctx context.Context, db *sql.DB, tableName string, recreate bool) error {
+	exists, err := tableExists(ctx, db, tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return createNewTable(ctx, db, tableName)
+	} else {
+		return validateTableSchema(ctx, db, tableName, recreate)
+	}
+}
+
+func tableExists(ctx context.Context, db *sql.DB, tableName string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public' AND table_name = $1", tableName).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func createNewTable(ctx context.Context, db *sql.DB, tableName string) error {
+	createTableSQL := `
+    CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(tableName) + ` (
+        activity_uuid VARCHAR(255) PRIMARY KEY,
+        user_uid VARCHAR(255),
+        organization_id VARCHAR(255),
+        timestamp TIMESTAMP,
+        app_name VARCHAR(255),
+        url VARCHAR(255),
+        page_title VARCHAR(255),
+        productivity_status VARCHAR(255),
+        meridian VARCHAR(255),
+        ip_address VARCHAR(255),
+        mac_address VARCHAR(255),
+        mouse_movement BOOLEAN,
+        mouse_clicks INTEGER,
+        keys_clicks INTEGER,
+        status INTEGER,
+        cpu_usage VARCHAR(255),
+        ram_usage VARCHAR(255),
+        screenshot_uid VARCHAR(255),
+        thumbnail_uid VARCHAR(255), 
+        device_user_name VARCHAR(50)
+    );`
+
+	_, err := db.ExecContext(ctx, createTableSQL)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Table created successfully", "table", tableName)
+	return ensureIndexes(ctx, db, tableName)
+}
+
+// ensureIndexes creates the indexes used by the reporting queries, which
+// filter by organization and user over a timestamp range.
+func ensureIndexes(ctx context.Context, db *sql.DB, tableName string) error {
+	indexes := []struct {
+		name    string
+		columns string
+	}{
+		{tableName + orgUserTimestampIndexSuffix, "organization_id, user_uid, timestamp"},
+		{tableName + timestampIndexSuffix, "timestamp"},
+	}
+
+	for _, idx := range indexes {
+		name := idx.name
+
+		owner, err := indexOwner(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("error checking index %s: %v", name, err)
+		}
+		if owner == tableName {
+			slog.Info("Index already present", "table", tableName, "index", name)
+			continue
+		}
+		if owner != "" {
+			return fmt.Errorf("index %s already exists on table %s", name, owner)
+		}
+
+		createIndexSQL := "CREATE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(name) + " ON " + pq.QuoteIdentifier(tableName) + " (" + idx.columns + ");"
+		if _, err := db.ExecContext(ctx, createIndexSQL); err != nil {
+			return fmt.Errorf("error creating index %s: %v", name, err)
+		}
+
+		// IF NOT EXISTS only raises a notice if another table took the name
+		// in the meantime, so confirm the index is really ours.
+		owner, err = indexOwner(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("error checking index %s: %v", name, err)
+		}
+		if owner != tableName {
+			return fmt.Errorf("index %s was not created on table %s", name, tableName)
+		}
+		slog.Info("Index created", "table", tableName, "index", name, "columns", idx.columns)
+	}
+	return nil
+}
+
+// indexOwner returns the table that owns the named index, or "" if there is
+// none. Index names are unique per schema, not per table.
+func indexOwner(ctx context.Context, db *sql.DB, indexName string) (string, error) {
+	var owner string
+	err := db.QueryRowContext(ctx, "SELECT tablename FROM pg_indexes WHERE schemaname = 'public' AND indexname = $1", indexName).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return owner, err
+}
+
+func validateTableSchema(ctx context.Context, db *sql.DB, tableName string, recreate bool) error {
+	query := `
+    SELECT column_name, data_type, is_nullable 
+    FROM information_schema.columns 
+    WHERE table_name = $1 AND table_schema = 'public'
+    ORDER BY ordinal_position;
+    `
+
+	rows, err := db.QueryContext(ctx, query, tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	// ✅ FIXED: Added thumbnail_uid to expected columns
+	expectedColumns := map[string]bool{
+		"activity_uuid":       false,
+		"user_uid":            false,
+		"organization_id":     false,
+		"timestamp":           false,
+		"app_name":            false,
+		"url":                 false,
+		"page_title":          false,
+		"productivity_status": false,
+		"meridian":            false,
+		"ip_address":          false,
+		"mac_address":         false,
+		"mouse_movement":      false,
+		"mouse_clicks":        false,
+		"keys_clicks":         false,
+		"status":              false,
+		"cpu_usage":           false,
+		"ram_usage":           false,
+		"screenshot_uid":      false,
+		"thumbnail_uid":       false, // ✅ Added this
+		"device_user_name":    false,
+	}
+
+	schemaIssues := false
+	for rows.Next() {
+		var columnName, dataType, isNullable string
+		if err := rows.Scan(&columnName, &dataType, &isNullable); err != nil {
+			return err
+		}
+
+		if _, exists := expectedColumns[columnName]; exists {
+			expectedColumns[columnName] = true
+		} else {
+			slog.Warn("Unexpected column found", "table", tableName, "column", columnName)
+			schemaIssues = true
+		}
+	}
+
+	// Check for missing columns
+	for col, found := range expectedColumns {
+		if !found {
+			slog.Error("Missing column", "table", tableName, "column", col)
+			schemaIssues = true
+		}
+	}
+
+	if schemaIssues {
+		if !recreate {
+			return fmt.Errorf("table %s does not match the expected schema; fix ACTIVITY_TABLE or set ACTIVITY_TABLE_RECREATE=true to drop and recreate it", tableName)
+		}
+		slog.Warn("Schema issues detected, recreating table", "table", tableName)
+		return recreateTable(ctx, db, tableName)
+	}
+
+	slog.Info("Table schema validation passed", "table", tableName)
+	return ensureIndexes(ctx, db, tableName)
+}
+
+func recreateTable(ctx context.Context, db *sql.DB, tableName string) error {
+	dropSQL := "DROP TABLE IF EXISTS " + pq.QuoteIdentifier(tableName) + ";"
+	_, err := db.ExecContext(ctx, dropSQL)
+	if err != nil {
+		return fmt.Errorf("error dropping table: %v", err)
+	}
+
+	slog.Info("Dropped existing table", "table", tableName)
+	return createNewTable(ctx, db, tableName)
+}
+
+// activityStatements holds the statements used on every message, prepared
+// once at startup so the driver doesn't re-parse them for each batch.
+type activityStatements struct {
+	tableName string
+	exists    *sql.Stmt
+	insert    *sql.Stmt
+	count     *sql.Stmt
+}
+
+func existsSQL(tableName string) string {
+	return "SELECT COUNT(*) FROM " + pq.QuoteIdentifier(tableName) + " WHERE activity_uuid = $1"
+}
+
+func insertSQL(tableName string) string {
+	return `
+    INSERT INTO ` + pq.QuoteIdentifier(tableName) + ` (activity_uuid, user_uid, organization_id, timestamp, app_name, url, page_title, productivity_status, meridian, ip_address, mac_address, mouse_movement, mouse_clicks, keys_clicks, status, cpu_usage, ram_usage, screenshot_uid, thumbnail_uid, device_user_name)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+    `
+}
+
+func prepareStatements(ctx context.Context, db *sql.DB, tableName string) (*activityStatements, error) {
+	stmts := &activityStatements{tableName: tableName}
+	var err error
+
+	if stmts.exists, err = db.PrepareContext(ctx, existsSQL(tableName)); err != nil {
+		stmts.Close()
+		return nil, fmt.Errorf("error preparing duplicate check: %v", err)
+	}
+	if stmts.insert, err = db.PrepareContext(ctx, insertSQL(tableName)); err != nil {
+		stmts.Close()
+		return nil, fmt.Errorf("error preparing insert: %v", err)
+	}
+	if stmts.count, err = db.PrepareContext(ctx, "SELECT COUNT(*) FROM "+pq.QuoteIdentifier(tableName)); err != nil {
+		stmts.Close()
+		return nil, fmt.Errorf("error preparing count: %v", err)
+	}
+	return stmts, nil
+}
+
+func (s *activityStatements) Close() {
+	for _, stmt := range []*sql.Stmt{s.exists, s.insert, s.count} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+// ✅ FIXED: Added duplicate prevention
+func insertOrUpdateProject(ctx context.Context, stmts *activityStatements, data InfoData) error {
+	// Check if record already exists
+	var count int
+	err := stmts.exists.QueryRowContext(ctx, data.ActivityUUID).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		slog.Info("Record already exists, skipping", "activity_uuid", data.ActivityUUID)
+		return nil // Skip duplicate
+	}
+
+	// Insert new record
+	slog.Debug("Inserting new record", "activity_uuid", data.ActivityUUID, "user_uid", data.UserUID)
+
+	_, err = stmts.insert.ExecContext(ctx, data.ActivityUUID, data.UserUID, data.OrganizationID, data.Timestamp, data.AppName, data.URL, data.PageTitle, data.ProductivityStatus, data.Meridian, data.IPAddress, data.MacAddress, data.MouseMovement, data.MouseClicks, data.KeysClicks, data.Status, data.CPUUsage, data.RAMUsage, data.ScreenshotUID, data.ThumbnailUID, data.Device_user_name)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Data inserted successfully", "activity_uuid", data.ActivityUUID)
+	return nil
+}
+
+// confirmDataAdded logs the table's row count. COUNT(*) scans the whole
+// table, so it only runs when debug logging is on.
+func confirmDataAdded(ctx context.Context, stmts *activityStatements) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	var count int
+	err := stmts.count.QueryRowContext(ctx).Scan(&count)
+	if err != nil {
+		slog.Error("Error counting records", "table", stmts.tableName, "error", err)
+		return
+	}
+
+	slog.Debug("Total records", "table", stmts.tableName, "count", count)
+}
+
+func inspectTableStructure(ctx context.Context, db *sql.DB, tableName string) {
+	query := `
+    SELECT column_name, data_type, is_nullable, column_default
+    FROM information_schema.columns 
+    WHERE table_name = $1 AND table_schema = 'public'
+    ORDER BY ordinal_position;
+    `
+
+	rows, err := db.QueryContext(ctx, query, tableName)
+	if err != nil {
+		slog.Error("Error inspecting table structure", "table", tableName, "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var columnName, dataType, isNullable string
+		var columnDefault sql.NullString
+
+		if err := rows.Scan(&columnName, &dataType, &isNullable, &columnDefault); err != nil {
+			slog.Error("Error scanning row", "table", tableName, "error", err)
+			continue
+		}
+
+		defaultVal := "NULL"
+		if columnDefault.Valid {
+			defaultVal = columnDefault.String
+		}
+
+		slog.Info("Table column", "table", tableName, "column", columnName, "data_type", dataType, "nullable", isNullable, "default", defaultVal)
+	}
+}
@@ -0,0 +1,381 @@
+package consumer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestValidateTableName(t *testing.T) {
+	for _, name := range []string{"user_activity", "user_activity_staging", "_t1", "user", "order"} {
+		if err := ValidateTableName(name); err != nil {
+			t.Errorf("ValidateTableName(%q) = %v, want nil", name, err)
+		}
+	}
+	// 47 characters is the longest name whose index names fit in 63 bytes.
+	if err := ValidateTableName(strings.Repeat("a", 47)); err != nil {
+		t.Errorf("ValidateTableName(47 chars) = %v, want nil", err)
+	}
+	for _, name := range []string{"", "User_Activity", "1table", "user_activity; DROP TABLE x", "a-b", "t\"x", strings.Repeat("a", 48), strings.Repeat("a", 63)} {
+		if err := ValidateTableName(name); err == nil {
+			t.Errorf("ValidateTableName(%q) = nil, want error", name)
+		}
+	}
+}
+
+// newMockStore returns a PostgresStore backed by sqlmock with its
+// statements already prepared.
+func newMockStore(t *testing.T) (*PostgresStore, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mock.ExpectPrepare(regexp.QuoteMeta(existsSQL("user_activity")))
+	mock.ExpectPrepare(regexp.QuoteMeta(insertSQL("user_activity")))
+	mock.ExpectPrepare(regexp.QuoteMeta(`SELECT COUNT(*) FROM "user_activity"`))
+
+	store, err := NewPostgresStore(db, "user_activity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.stmts, err = prepareStatements(context.Background(), db, "user_activity"); err != nil {
+		t.Fatal(err)
+	}
+	return store, mock
+}
+
+func TestPostgresStoreInsert(t *testing.T) {
+	store, mock := newMockStore(t)
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO "user_activity"`).
+		WithArgs("a1", "u1", "o1", ts, "app", "", "", "", "", "", "", false, 0, 0, 0, "", "", "", "", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// a2 is already stored, so no insert is expected.
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	records := []InfoData{
+		{ActivityUUID: "a1", UserUID: "u1", OrganizationID: "o1", Timestamp: ts, AppName: "app"},
+		{ActivityUUID: "a2"},
+	}
+	if err := store.Insert(context.Background(), records); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresStoreInsertSkipsDataErrors(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO "user_activity"`).
+		WillReturnError(&pq.Error{Code: "22001", Message: "value too long for type character varying(50)"})
+	// The rejected record must not stop the remaining records.
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO "user_activity"`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := store.Insert(context.Background(), []InfoData{{ActivityUUID: "a1"}, {ActivityUUID: "a2"}}); err != nil {
+		t.Fatalf("Insert error = %v, want data error skipped", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresStoreInsertReturnsFirstError(t *testing.T) {
+	store, mock := newMockStore(t)
+	connErr := errors.New("connection reset by peer")
+
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO "user_activity"`).WillReturnError(connErr)
+	mock.ExpectQuery("SELECT COUNT").WithArgs("a2").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO "user_activity"`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := store.Insert(context.Background(), []InfoData{{ActivityUUID: "a1"}, {ActivityUUID: "a2"}})
+	if !errors.Is(err, connErr) {
+		t.Fatalf("Insert error = %v, want %v", err, connErr)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmDataAddedOnlyAtDebug(t *testing.T) {
+	store, mock := newMockStore(t)
+
+	// TestMain logs at Info, so the count query must not run.
+	confirmDataAdded(context.Background(), store.stmts)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	mock.ExpectQuery("SELECT COUNT").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	confirmDataAdded(context.Background(), store.stmts)
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresStoreInsertRequiresSchema(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := NewPostgresStore(db, "user_activity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(context.Background(), []InfoData{{ActivityUUID: "a1"}}); err == nil {
+		t.Fatal("Insert before EnsureSchema succeeded, want error")
+	}
+}
+
+// indexRows is the pg_indexes lookup result for an index owned by table, or
+// no row if table is empty.
+func indexRows(table string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"tablename"})
+	if table != "" {
+		rows.AddRow(table)
+	}
+	return rows
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_activity_org_user_ts_idx").WillReturnRows(indexRows("user_activity"))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_activity_ts_idx").WillReturnRows(indexRows(""))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE INDEX IF NOT EXISTS "user_activity_ts_idx" ON "user_activity" (timestamp);`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_activity_ts_idx").WillReturnRows(indexRows("user_activity"))
+
+	if err := ensureIndexes(context.Background(), db, "user_activity"); err != nil {
+		t.Fatalf("ensureIndexes: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnsureIndexesNameTakenByAnotherTable(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Table x owns x_org_user_ts_idx, which is also the timestamp index
+	// name derived for table x_org_user.
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("x_org_user_org_user_ts_idx").WillReturnRows(indexRows("x_org_user"))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("x_org_user_ts_idx").WillReturnRows(indexRows("x"))
+
+	if err := ensureIndexes(context.Background(), db, "x_org_user"); err == nil || !strings.Contains(err.Error(), "already exists on table x") {
+		t.Fatalf("ensureIndexes error = %v, want collision error", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// The name can also be taken between the check and the CREATE, which
+	// IF NOT EXISTS only reports as a notice.
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("x_org_user_org_user_ts_idx").WillReturnRows(indexRows("x_org_user"))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("x_org_user_ts_idx").WillReturnRows(indexRows(""))
+	mock.ExpectExec("CREATE INDEX IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("x_org_user_ts_idx").WillReturnRows(indexRows("x"))
+
+	if err := ensureIndexes(context.Background(), db, "x_org_user"); err == nil {
+		t.Fatal("ensureIndexes succeeded when the index was not created, want error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateNewTableQuotesReservedWords(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "user" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_org_user_ts_idx").WillReturnRows(indexRows(""))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE INDEX IF NOT EXISTS "user_org_user_ts_idx" ON "user" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_org_user_ts_idx").WillReturnRows(indexRows("user"))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_ts_idx").WillReturnRows(indexRows(""))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE INDEX IF NOT EXISTS "user_ts_idx" ON "user" (`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WithArgs("user_ts_idx").WillReturnRows(indexRows("user"))
+
+	if err := createNewTable(context.Background(), db, "user"); err != nil {
+		t.Fatalf("createNewTable: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateTableSchemaMismatch(t *testing.T) {
+	columns := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"column_name", "data_type", "is_nullable"}).
+			AddRow("id", "integer", "NO").
+			AddRow("total", "numeric", "YES")
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Without the opt-in an unrelated table must be left alone; sqlmock
+	// fails the DROP since it isn't expected.
+	mock.ExpectQuery("FROM information_schema.columns").WithArgs("orders").WillReturnRows(columns())
+	if err := validateTableSchema(context.Background(), db, "orders", false); err == nil {
+		t.Fatal("validateTableSchema succeeded on a mismatched table, want error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	mock.ExpectQuery("FROM information_schema.columns").WithArgs("orders").WillReturnRows(columns())
+	mock.ExpectExec("DROP TABLE IF EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("FROM pg_indexes").WillReturnRows(indexRows("orders"))
+	mock.ExpectQuery("FROM pg_indexes").WillReturnRows(indexRows("orders"))
+	if err := validateTableSchema(context.Background(), db, "orders", true); err != nil {
+		t.Fatalf("validateTableSchema with recreate: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+const benchRows = 10000
+
+// openBenchDB connects to the database named by POSTGRES_TEST_CONN_STR and
+// creates a scratch table, skipping the benchmark when no database is set.
+func openBenchDB(b *testing.B) (*sql.DB, string) {
+	connStr := os.Getenv("POSTGRES_TEST_CONN_STR")
+	if connStr == "" {
+		b.Skip("POSTGRES_TEST_CONN_STR not set")
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		b.Fatal(err)
+	}
+
+	// Per-row logging would dominate the timings.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tableName := "user_activity_bench"
+	if err := createNewTable(context.Background(), db, tableName); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		db.Exec("DROP TABLE IF EXISTS " + pq.QuoteIdentifier(tableName))
+		db.Close()
+	})
+	return db, tableName
+}
+
+func benchRecords() []InfoData {
+	records := make([]InfoData, benchRows)
+	for i := range records {
+		records[i] = InfoData{
+			ActivityUUID:       fmt.Sprintf("bench-%d", i),
+			UserUID:            "bench-user",
+			OrganizationID:     "bench-org",
+			Timestamp:          time.Now(),
+			AppName:            "bench",
+			ProductivityStatus: "productive",
+		}
+	}
+	return records
+}
+
+func truncate(b *testing.B, db *sql.DB, tableName string) {
+	b.StopTimer()
+	if _, err := db.Exec("TRUNCATE " + pq.QuoteIdentifier(tableName)); err != nil {
+		b.Fatal(err)
+	}
+	b.StartTimer()
+}
+
+// BenchmarkInsertUnprepared rebuilds and re-parses the SQL for every row,
+// as the consumer did before statements were prepared.
+func BenchmarkInsertUnprepared(b *testing.B) {
+	db, tableName := openBenchDB(b)
+	records := benchRecords()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		truncate(b, db, tableName)
+		for _, data := range records {
+			var count int
+			if err := db.QueryRow(existsSQL(tableName), data.ActivityUUID).Scan(&count); err != nil {
+				b.Fatal(err)
+			}
+			_, err := db.Exec(insertSQL(tableName), data.ActivityUUID, data.UserUID, data.OrganizationID, data.Timestamp, data.AppName, data.URL, data.PageTitle, data.ProductivityStatus, data.Meridian, data.IPAddress, data.MacAddress, data.MouseMovement, data.MouseClicks, data.KeysClicks, data.Status, data.CPUUsage, data.RAMUsage, data.ScreenshotUID, data.ThumbnailUID, data.Device_user_name)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkInsertPrepared(b *testing.B) {
+	db, tableName := openBenchDB(b)
+	records := benchRecords()
+	ctx := context.Background()
+
+	stmts, err := prepareStatements(ctx, db, tableName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stmts.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		truncate(b, db, tableName)
+		for _, data := range records {
+			if err := insertOrUpdateProject(ctx, stmts, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}